@@ -68,25 +68,66 @@ func ShouldRead(src io.ByteReader, expected byte) error {
 	return nil
 }
 
+// Pos is a position (line, column and byte offset, all but Offset 1-based
+// for Line/Column) in a byte stream, tracked independently of any splicing
+// a reader in this package might perform.
+type Pos struct {
+	Line   int
+	Column int
+	Offset int
+}
+
+// PosReader is implemented by readers in this package that can report, for
+// every byte they hand back from ReadPos, the position that byte had before
+// any splicing (e.g. backslash-newline removal) took place.
+type PosReader interface {
+	ReadPos(bs []byte, pos []Pos) (int, error)
+}
+
 type BackslashNewLineStripper struct {
 	r      io.Reader
 	buf    []byte
+	bufPos []Pos
+	pos    Pos
 	lastbs bool
-	eof    bool
+	// bsPos is the pre-splice position of the pending backslash lastbs
+	// refers to, i.e. the position a diagnostic should use if that
+	// backslash turns out not to start a line splice and gets replayed.
+	bsPos Pos
+	eof   bool
 }
 
 func NewBackslashNewLineStripper(r io.Reader) *BackslashNewLineStripper {
 	return &BackslashNewLineStripper{
-		r: r,
+		r:   r,
+		pos: Pos{Line: 1, Column: 1},
 	}
 }
 
 func (s *BackslashNewLineStripper) Read(bs []byte) (int, error) {
+	return s.ReadPos(bs, make([]Pos, len(bs)))
+}
+
+// ReadPos behaves like Read, except that for every byte bs[i] it returns it
+// also sets pos[i] to that byte's position in the pre-splice input, i.e.
+// the position a diagnostic should point at if it concerns bs[i]. pos must
+// have at least as much room as bs.
+func (s *BackslashNewLineStripper) ReadPos(bs []byte, pos []Pos) (int, error) {
 	var err error
 	for len(s.buf) < len(bs) && !s.eof {
 		buf := make([]byte, len(bs)-len(s.buf))
 		n := 0
 		n, err = s.r.Read(buf)
+		for _, b := range buf[:n] {
+			s.bufPos = append(s.bufPos, s.pos)
+			s.pos.Offset++
+			if b == '\n' {
+				s.pos.Line++
+				s.pos.Column = 1
+			} else {
+				s.pos.Column++
+			}
+		}
 		s.buf = append(s.buf, buf[:n]...)
 		if err != nil {
 			if err != io.EOF {
@@ -98,36 +139,50 @@ func (s *BackslashNewLineStripper) Read(bs []byte) (int, error) {
 
 	dstI := 0
 	for dstI < len(bs) && 0 < len(s.buf) {
+		origin := s.bufPos[0]
 		switch s.buf[0] {
 		case '\\':
 			if s.lastbs {
 				bs[dstI] = '\\'
+				pos[dstI] = s.bsPos
 				dstI++
 			}
 		case '\n':
 			if !s.lastbs {
 				bs[dstI] = s.buf[0]
+				pos[dstI] = origin
 				dstI++
 			}
 		default:
 			if s.lastbs {
 				bs[dstI] = '\\'
+				pos[dstI] = s.bsPos
 				dstI++
 				if dstI >= len(bs) {
 					s.lastbs = s.buf[0] == '\\'
+					if s.lastbs {
+						s.bsPos = origin
+					}
 					s.buf = s.buf[1:]
+					s.bufPos = s.bufPos[1:]
 					break
 				}
 			}
 			bs[dstI] = s.buf[0]
+			pos[dstI] = origin
 			dstI++
 		}
 		s.lastbs = s.buf[0] == '\\'
+		if s.lastbs {
+			s.bsPos = origin
+		}
 		s.buf = s.buf[1:]
+		s.bufPos = s.bufPos[1:]
 
 		// Special tretment for the last backslash
 		if s.eof && len(s.buf) == 0 && s.lastbs && dstI < len(bs) {
 			bs[dstI] = '\\'
+			pos[dstI] = s.bsPos
 			dstI++
 		}
 	}
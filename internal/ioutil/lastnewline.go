@@ -0,0 +1,65 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ioutil
+
+import "io"
+
+// LastNewLineAdder ensures the stream it wraps ends with a newline, per
+// translation phase 2 (C11 5.1.1.2p2: "a source file that is not empty
+// shall end in a new-line character"). Most real source files already do;
+// this reader only appends one of its own when the wrapped reader's last
+// byte wasn't '\n', so well-formed input passes through unchanged.
+type LastNewLineAdder struct {
+	r        io.Reader
+	lastByte byte
+	sawByte  bool
+	eof      bool
+}
+
+func NewLastNewLineAdder(r io.Reader) *LastNewLineAdder {
+	return &LastNewLineAdder{r: r}
+}
+
+func (a *LastNewLineAdder) Read(bs []byte) (int, error) {
+	if len(bs) == 0 {
+		return 0, nil
+	}
+
+	if !a.eof {
+		n, err := a.r.Read(bs)
+		if n > 0 {
+			a.sawByte = true
+			a.lastByte = bs[n-1]
+		}
+		if err == nil {
+			return n, nil
+		}
+		if err != io.EOF {
+			return n, err
+		}
+		a.eof = true
+		if n > 0 {
+			return n, nil
+		}
+	}
+
+	if a.sawByte && a.lastByte != '\n' {
+		// Only ever add the one missing newline.
+		a.sawByte = false
+		bs[0] = '\n'
+		return 1, nil
+	}
+	return 0, io.EOF
+}
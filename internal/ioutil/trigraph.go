@@ -0,0 +1,89 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ioutil
+
+import "io"
+
+// trigraphs maps the third character of a "??x" sequence to the single
+// character it stands for (C11 5.2.1.1 table). Any other "??" is left
+// untouched.
+var trigraphs = map[byte]byte{
+	'=':  '#',
+	'(':  '[',
+	'/':  '\\',
+	')':  ']',
+	'\'': '^',
+	'<':  '{',
+	'!':  '|',
+	'>':  '}',
+	'-':  '~',
+}
+
+// TrigraphReader replaces each trigraph sequence read from r with the
+// character it denotes, implementing translation phase 1 (C11 5.1.1.2p1).
+// It is a separate, opt-in reader rather than something Tokenize always
+// installs: trigraphs are all but extinct in real C source, and silently
+// rewriting, say, "??!" to "|" inside a string literal that never meant to
+// contain one is more likely to surprise a caller than help it.
+type TrigraphReader struct {
+	r   io.Reader
+	buf []byte
+	eof bool
+}
+
+func NewTrigraphReader(r io.Reader) *TrigraphReader {
+	return &TrigraphReader{r: r}
+}
+
+func (t *TrigraphReader) Read(bs []byte) (int, error) {
+	var err error
+	for len(t.buf) < len(bs)+2 && !t.eof {
+		tmp := make([]byte, len(bs)+2)
+		n := 0
+		n, err = t.r.Read(tmp)
+		t.buf = append(t.buf, tmp[:n]...)
+		if err != nil {
+			if err != io.EOF {
+				return 0, err
+			}
+			t.eof = true
+		}
+	}
+
+	dstI := 0
+	for dstI < len(bs) && len(t.buf) > 0 {
+		if len(t.buf) < 3 && !t.eof {
+			// Not enough lookahead to rule out a trigraph yet; let the
+			// next Read bring in the rest of it.
+			break
+		}
+		if len(t.buf) >= 3 && t.buf[0] == '?' && t.buf[1] == '?' {
+			if repl, ok := trigraphs[t.buf[2]]; ok {
+				bs[dstI] = repl
+				dstI++
+				t.buf = t.buf[3:]
+				continue
+			}
+		}
+		bs[dstI] = t.buf[0]
+		dstI++
+		t.buf = t.buf[1:]
+	}
+
+	if dstI == 0 && t.eof {
+		return 0, io.EOF
+	}
+	return dstI, nil
+}
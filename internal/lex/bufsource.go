@@ -0,0 +1,57 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lex
+
+// BufSource wraps a Source and records every discarded byte so that the
+// exact raw text of a multi-byte token (a literal, a header name, ...) can
+// be recovered afterward with Buf.
+//
+// Pos reports the position of the first byte read through the BufSource,
+// i.e. where the token it is building began, not the Source's current
+// position.
+type BufSource struct {
+	src Source
+	buf []byte
+	pos Pos
+}
+
+func NewBufSource(src Source) *BufSource {
+	return &BufSource{
+		src: src,
+		pos: src.Pos(),
+	}
+}
+
+func (s *BufSource) Peek(n int) ([]byte, error) {
+	return s.src.Peek(n)
+}
+
+func (s *BufSource) Discard(n int) (int, error) {
+	bs, peekErr := s.src.Peek(n)
+	discarded, err := s.src.Discard(len(bs))
+	s.buf = append(s.buf, bs[:discarded]...)
+	if err != nil {
+		return discarded, err
+	}
+	return discarded, peekErr
+}
+
+func (s *BufSource) Pos() Pos {
+	return s.pos
+}
+
+func (s *BufSource) Buf() string {
+	return string(s.buf)
+}
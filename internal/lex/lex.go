@@ -0,0 +1,44 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lex
+
+// Source is a peekable, discardable byte stream with a notion of its own
+// current position. Peek never advances the stream; Discard advances it and
+// moves Pos accordingly.
+type Source interface {
+	Peek(n int) ([]byte, error)
+	Discard(n int) (int, error)
+	Pos() Pos
+}
+
+func IsWhitespace(b byte) bool {
+	switch b {
+	case ' ', '\t', '\v', '\f', '\r', '\n':
+		return true
+	}
+	return false
+}
+
+func IsDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
+
+func IsNondigit(b byte) bool {
+	return b == '_' || ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z')
+}
+
+func IsHexDigit(b byte) bool {
+	return IsDigit(b) || ('a' <= b && b <= 'f') || ('A' <= b && b <= 'F')
+}
@@ -0,0 +1,265 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lex
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/hajimehoshi/goc/internal/ioutil"
+)
+
+// ReadIdentifier reads an identifier (C11 6.4.2.1) from src, decoding any
+// universal-character-names (C11 6.4.3) it contains along the way so that
+// the returned text is the identifier's spelling regardless of whether a
+// given character was written literally or as a UCN; each UCN's code point
+// is checked against the allowed-in-an-identifier ranges of Annex D. The
+// opening byte is assumed to already have been confirmed to satisfy
+// IsNondigit or IsUCNStart. If allowDollar is true, '$' is also accepted as
+// an identifier character, a common extension C11 itself doesn't specify.
+func ReadIdentifier(src Source, allowDollar bool) (string, error) {
+	name := []byte{}
+	for {
+		bs, err := src.Peek(2)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if len(bs) == 0 {
+			break
+		}
+		if IsUCNStart(bs) {
+			cp, _, err := ReadUCN(src)
+			if err != nil {
+				return "", err
+			}
+			if err := validateUCNIdentifier(cp, len(name) == 0); err != nil {
+				return "", err
+			}
+			name = append(name, []byte(string(cp))...)
+			continue
+		}
+		if !IsNondigit(bs[0]) && !IsDigit(bs[0]) && !(allowDollar && bs[0] == '$') {
+			break
+		}
+		src.Discard(1)
+		name = append(name, bs[0])
+	}
+	return string(name), nil
+}
+
+// ReadPPNumber reads a pp-number (C11 6.4.8) from src. The opening byte is
+// assumed to be a digit or the '.' of a '.'-digit pp-number.
+func ReadPPNumber(src Source) (string, error) {
+	val := []byte{}
+	for {
+		bs, err := src.Peek(1)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if len(bs) == 0 {
+			break
+		}
+		switch {
+		case bs[0] == 'e' || bs[0] == 'E' || bs[0] == 'p' || bs[0] == 'P':
+			src.Discard(1)
+			val = append(val, bs[0])
+			bs2, err := src.Peek(1)
+			if err != nil && err != io.EOF {
+				return "", err
+			}
+			if len(bs2) > 0 && (bs2[0] == '+' || bs2[0] == '-') {
+				src.Discard(1)
+				val = append(val, bs2[0])
+			}
+			continue
+		case bs[0] == '.' || IsDigit(bs[0]) || IsNondigit(bs[0]):
+			src.Discard(1)
+			val = append(val, bs[0])
+		default:
+			return string(val), nil
+		}
+	}
+	return string(val), nil
+}
+
+// ReadHeaderName reads a header-name (C11 6.4.7) from src, either
+// "h-char-sequence" or <h-char-sequence>, decoding any universal-character-
+// names (C11 6.4.3) an h-char-sequence contains, the same way ReadIdentifier
+// and the char/string literal readers do. The leading '"' or '<' has not
+// been discarded yet.
+func ReadHeaderName(src Source) (string, error) {
+	open, err := ioutil.ShouldPeekByte(src)
+	if err != nil {
+		return "", err
+	}
+	closing := byte('"')
+	if open == '<' {
+		closing = '>'
+	}
+	src.Discard(1)
+
+	name := []byte{}
+	for {
+		bs, err := src.Peek(2)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if len(bs) == 0 {
+			return "", fmt.Errorf("lex: unterminated header name")
+		}
+		if IsUCNStart(bs) {
+			cp, _, err := ReadUCN(src)
+			if err != nil {
+				return "", err
+			}
+			name = append(name, []byte(string(cp))...)
+			continue
+		}
+		b, err := readByte(src)
+		if err != nil {
+			return "", err
+		}
+		if b == closing {
+			break
+		}
+		if b == '\n' {
+			return "", fmt.Errorf("lex: unterminated header name")
+		}
+		name = append(name, b)
+	}
+	return string(name), nil
+}
+
+// ReadChar reads a character-constant (C11 6.4.4.4) from src, including the
+// surrounding single quotes, and returns the decoded value.
+func ReadChar(src Source) ([]byte, error) {
+	if err := ioutil.ShouldRead(byteReader{src}, '\''); err != nil {
+		return nil, err
+	}
+	val := []byte{}
+	for {
+		b, err := readByte(src)
+		if err != nil {
+			return nil, err
+		}
+		if b == '\'' {
+			break
+		}
+		if b == '\\' {
+			e, err := readEscapedByte(src)
+			if err != nil {
+				return nil, err
+			}
+			val = append(val, e...)
+			continue
+		}
+		val = append(val, b)
+	}
+	return val, nil
+}
+
+// ReadString reads a string-literal (C11 6.4.5) from src, including the
+// surrounding double quotes, and returns the decoded value.
+func ReadString(src Source) (string, error) {
+	if err := ioutil.ShouldRead(byteReader{src}, '"'); err != nil {
+		return "", err
+	}
+	val := []byte{}
+	for {
+		b, err := readByte(src)
+		if err != nil {
+			return "", err
+		}
+		if b == '"' {
+			break
+		}
+		if b == '\\' {
+			e, err := readEscapedByte(src)
+			if err != nil {
+				return "", err
+			}
+			val = append(val, e...)
+			continue
+		}
+		val = append(val, b)
+	}
+	return string(val), nil
+}
+
+// readEscapedByte reads the part of an escape sequence after the '\', which
+// has already been discarded. It returns a byte slice rather than a single
+// byte because a \u/\U universal-character-name escape (C11 6.4.4.4p8)
+// decodes to a whole UTF-8 rune.
+func readEscapedByte(src Source) ([]byte, error) {
+	b, err := readByte(src)
+	if err != nil {
+		return nil, err
+	}
+	switch b {
+	case 'n':
+		return []byte{'\n'}, nil
+	case 't':
+		return []byte{'\t'}, nil
+	case 'r':
+		return []byte{'\r'}, nil
+	case 'v':
+		return []byte{'\v'}, nil
+	case 'f':
+		return []byte{'\f'}, nil
+	case 'a':
+		return []byte{'\a'}, nil
+	case 'b':
+		return []byte{'\b'}, nil
+	case '\\', '\'', '"', '?':
+		return []byte{b}, nil
+	case 'u', 'U':
+		n := 4
+		if b == 'U' {
+			n = 8
+		}
+		cp, _, err := readHexDigits(src, n)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateUCN(cp); err != nil {
+			return nil, err
+		}
+		return []byte(string(cp)), nil
+	default:
+		return []byte{b}, nil
+	}
+}
+
+func readByte(src Source) (byte, error) {
+	bs, err := src.Peek(1)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if len(bs) == 0 {
+		return 0, io.EOF
+	}
+	src.Discard(1)
+	return bs[0], nil
+}
+
+// byteReader adapts a Source to io.ByteReader for ioutil helpers that were
+// written against the standard library interface.
+type byteReader struct {
+	src Source
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	return readByte(r.src)
+}
@@ -0,0 +1,150 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lex
+
+import (
+	"io"
+
+	"github.com/hajimehoshi/goc/internal/ioutil"
+)
+
+// source is the root Source implementation. It keeps its own read-ahead
+// buffer instead of delegating to bufio.Reader so that it can carry one
+// Pos alongside every buffered byte.
+//
+// When r is an ioutil.PosReader (e.g. a BackslashNewLineStripper), those
+// positions are the pre-splice positions reported by r, so a token that
+// starts right before a line-continuation still gets the position it had
+// before the continuation was spliced away. Otherwise, positions are
+// derived by simply counting bytes and newlines in r's output.
+type source struct {
+	filename string
+	r        io.Reader
+	posR     ioutil.PosReader // non-nil if r implements ioutil.PosReader
+
+	buf    []byte
+	bufPos []Pos
+
+	pos     Pos // position of buf[0], or of nextPos if buf is empty
+	nextPos Pos // running position of the next not-yet-buffered byte
+
+	eof bool
+}
+
+// NewSource creates a Source reading from r. filename is recorded in every
+// Pos produced by the returned Source and is typically shown to the user in
+// diagnostics.
+func NewSource(filename string, r io.Reader) Source {
+	start := Pos{Filename: filename, Line: 1, Column: 1}
+	s := &source{
+		filename: filename,
+		r:        r,
+		pos:      start,
+		nextPos:  start,
+	}
+	if posR, ok := r.(ioutil.PosReader); ok {
+		s.posR = posR
+	}
+	return s
+}
+
+func (s *source) fill(n int) error {
+	for len(s.buf) < n && !s.eof {
+		tmp := make([]byte, 4096)
+		var read int
+		var err error
+		if s.posR != nil {
+			tmpPos := make([]ioutil.Pos, len(tmp))
+			read, err = s.posR.ReadPos(tmp, tmpPos)
+			for i, p := range tmpPos[:read] {
+				s.nextPos = Pos{
+					Filename: s.filename,
+					Line:     p.Line,
+					Column:   p.Column,
+					Offset:   p.Offset,
+				}
+				s.bufPos = append(s.bufPos, s.advancePos(tmp[i]))
+			}
+		} else {
+			read, err = s.r.Read(tmp)
+			for i := 0; i < read; i++ {
+				s.bufPos = append(s.bufPos, s.advancePos(tmp[i]))
+			}
+		}
+		s.buf = append(s.buf, tmp[:read]...)
+		if err != nil {
+			if err != io.EOF {
+				return err
+			}
+			s.eof = true
+		}
+	}
+	if len(s.bufPos) > 0 {
+		s.pos = s.bufPos[0]
+	}
+	return nil
+}
+
+// advancePos reports the position of the byte about to be appended to buf
+// (b) and advances nextPos past it. For a reader that implements
+// ioutil.PosReader, fill first sets nextPos to the pre-splice position the
+// reader reported for b.
+func (s *source) advancePos(b byte) Pos {
+	p := s.nextPos
+	s.nextPos.Offset++
+	if b == '\n' {
+		s.nextPos.Line++
+		s.nextPos.Column = 1
+	} else {
+		s.nextPos.Column++
+	}
+	return p
+}
+
+func (s *source) Peek(n int) ([]byte, error) {
+	if err := s.fill(n); err != nil {
+		return nil, err
+	}
+	if len(s.buf) < n {
+		return s.buf, io.EOF
+	}
+	return s.buf[:n], nil
+}
+
+func (s *source) Discard(n int) (int, error) {
+	if err := s.fill(n); err != nil {
+		return 0, err
+	}
+	if n > len(s.buf) {
+		n = len(s.buf)
+	}
+	s.buf = s.buf[n:]
+	s.bufPos = s.bufPos[n:]
+
+	// s.pos always reports the position of buf[0] (the next byte a caller
+	// will see), so update it to whatever is now at the front -- or, if the
+	// look-ahead buffer is now empty, to the running position of the
+	// not-yet-buffered byte that follows.
+	if len(s.bufPos) > 0 {
+		s.pos = s.bufPos[0]
+	} else {
+		s.pos = s.nextPos
+	}
+	return n, nil
+}
+
+func (s *source) Pos() Pos {
+	return s.pos
+}
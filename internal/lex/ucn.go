@@ -0,0 +1,144 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lex
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hajimehoshi/goc/internal/ioutil"
+)
+
+// IsUCNStart reports whether bs, a 2-byte lookahead, begins a
+// universal-character-name (C11 6.4.3): "\u" or "\U".
+func IsUCNStart(bs []byte) bool {
+	return len(bs) >= 2 && bs[0] == '\\' && (bs[1] == 'u' || bs[1] == 'U')
+}
+
+// ReadUCN reads a universal-character-name from src and returns its code
+// point together with its exact spelling ("\uXXXX" or "\UXXXXXXXX"). Neither
+// the '\' nor the following 'u'/'U' has been discarded yet; src.Peek(2) must
+// already satisfy IsUCNStart.
+func ReadUCN(src Source) (rune, string, error) {
+	bs, err := ioutil.ShouldPeek(src, 2)
+	if err != nil {
+		return 0, "", err
+	}
+	src.Discard(2)
+	n := 4
+	if bs[1] == 'U' {
+		n = 8
+	}
+	cp, hex, err := readHexDigits(src, n)
+	if err != nil {
+		return 0, "", err
+	}
+	if err := validateUCN(cp); err != nil {
+		return 0, "", err
+	}
+	return cp, string(bs) + hex, nil
+}
+
+func readHexDigits(src Source, n int) (rune, string, error) {
+	hex := make([]byte, 0, n)
+	for i := 0; i < n; i++ {
+		b, err := ioutil.ShouldPeekByte(src)
+		if err != nil {
+			return 0, "", err
+		}
+		if !IsHexDigit(b) {
+			return 0, "", fmt.Errorf("lex: universal character name must have %d hex digits", n)
+		}
+		src.Discard(1)
+		hex = append(hex, b)
+	}
+	v, err := strconv.ParseUint(string(hex), 16, 32)
+	if err != nil {
+		return 0, "", fmt.Errorf("lex: invalid universal character name \\u%s", hex)
+	}
+	return rune(v), string(hex), nil
+}
+
+// validateUCN rejects the universal-character-names that C11 6.4.3p2
+// disallows outright; Annex D only extends which named characters a UCN may
+// spell inside an identifier, it does not relax these.
+func validateUCN(cp rune) error {
+	if cp >= 0xd800 && cp <= 0xdfff {
+		return fmt.Errorf("lex: universal character name \\u%04X designates a surrogate code point", cp)
+	}
+	if cp < 0xa0 && cp != 0x24 && cp != 0x40 && cp != 0x60 {
+		return fmt.Errorf("lex: universal character name \\u%04X designates a character below U+00A0", cp)
+	}
+	return nil
+}
+
+// annexDRanges lists the code-point ranges C11 Annex D.1 allows a UCN in an
+// identifier to designate, beyond plain ASCII.
+var annexDRanges = [][2]rune{
+	{0x00A8, 0x00A8}, {0x00AA, 0x00AA}, {0x00AD, 0x00AD}, {0x00AF, 0x00AF},
+	{0x00B2, 0x00B5}, {0x00B7, 0x00BA}, {0x00BC, 0x00BE}, {0x00C0, 0x00D6},
+	{0x00D8, 0x00F6}, {0x00F8, 0x00FF},
+	{0x0100, 0x167F}, {0x1681, 0x180D}, {0x180F, 0x1FFF},
+	{0x200B, 0x200D}, {0x202A, 0x202E}, {0x203F, 0x2040}, {0x2054, 0x2054}, {0x2060, 0x206F},
+	{0x2070, 0x218F}, {0x2460, 0x24FF}, {0x2776, 0x2793},
+	{0x2C00, 0x2DFF}, {0x2E80, 0x2FFF},
+	{0x3004, 0x3007}, {0x3021, 0x302F}, {0x3031, 0x303F},
+	{0x3040, 0xD7FF},
+	{0xF900, 0xFD3D}, {0xFD40, 0xFDCF}, {0xFDF0, 0xFE44}, {0xFE47, 0xFFFD},
+	{0x10000, 0x1FFFD}, {0x20000, 0x2FFFD}, {0x30000, 0x3FFFD}, {0x40000, 0x4FFFD},
+	{0x50000, 0x5FFFD}, {0x60000, 0x6FFFD}, {0x70000, 0x7FFFD}, {0x80000, 0x8FFFD},
+	{0x90000, 0x9FFFD}, {0xA0000, 0xAFFFD}, {0xB0000, 0xBFFFD}, {0xC0000, 0xCFFFD},
+	{0xD0000, 0xDFFFD}, {0xE0000, 0xEFFFD},
+}
+
+// annexDInitialDisallowed lists the ranges C11 Annex D.2 excludes from an
+// identifier's initial character, even though D.1 allows them to appear
+// later in one (they're combining characters).
+var annexDInitialDisallowed = [][2]rune{
+	{0x0300, 0x036F}, {0x1DC0, 0x1DFF}, {0x20D0, 0x20FF}, {0xFE20, 0xFE2F},
+}
+
+func inRanges(cp rune, ranges [][2]rune) bool {
+	for _, r := range ranges {
+		if cp >= r[0] && cp <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// validateUCNIdentifier applies C11 Annex D on top of the restrictions
+// validateUCN already enforces, for a UCN appearing in an identifier: its
+// code point must be one Annex D.1 allows an identifier to contain at all,
+// and, if initial is true (this is the identifier's first character), one
+// Annex D.2 doesn't reserve for combining use later in the identifier only.
+func validateUCNIdentifier(cp rune, initial bool) error {
+	if err := validateUCN(cp); err != nil {
+		return err
+	}
+	if cp < 0x80 {
+		// validateUCN has already rejected every code point below 0xA0
+		// except '$', '@' and '`'; Annex D only constrains non-ASCII code
+		// points, so those three are not restricted any further here.
+		return nil
+	}
+	if !inRanges(cp, annexDRanges) {
+		return fmt.Errorf("lex: universal character name \\u%04X is not allowed in an identifier", cp)
+	}
+	if initial && inRanges(cp, annexDInitialDisallowed) {
+		return fmt.Errorf("lex: universal character name \\u%04X cannot be the initial character of an identifier", cp)
+	}
+	return nil
+}
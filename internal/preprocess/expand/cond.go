@@ -0,0 +1,358 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expand
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/hajimehoshi/goc/internal/lex"
+	"github.com/hajimehoshi/goc/internal/preprocess"
+)
+
+// evalConstExpr evaluates the controlling expression of an #if or #elif,
+// per C11 6.10.1: the "defined" operator is resolved against line before
+// anything else is macro-expanded, then the remaining tokens are expanded,
+// then any identifier still left (including a stray "true"/"false", which
+// are not keywords here) becomes 0.
+func (e *Expander) evalConstExpr(line []hsToken, pos lex.Pos) (int64, error) {
+	resolved, err := e.resolveDefined(line)
+	if err != nil {
+		return 0, err
+	}
+	expanded, err := e.expandArg(resolved)
+	if err != nil {
+		return 0, err
+	}
+
+	final := make([]hsToken, 0, len(expanded))
+	for _, t := range expanded {
+		if t.tok.Type == preprocess.Identifier {
+			final = append(final, hsToken{tok: &preprocess.Token{Type: preprocess.PPNumber, Val: "0", Raw: "0", Pos: t.tok.Pos}})
+			continue
+		}
+		final = append(final, t)
+	}
+	if len(final) == 0 {
+		return 0, newError(pos, "#if with no expression")
+	}
+
+	p := &exprParser{toks: final}
+	val, err := p.parseExpr()
+	if err != nil {
+		return 0, err
+	}
+	if p.pos != len(p.toks) {
+		return 0, newError(p.toks[p.pos].tok.Pos, "unexpected token in #if expression")
+	}
+	return val, nil
+}
+
+// resolveDefined replaces every "defined IDENT" or "defined ( IDENT )" in
+// line with a 0 or 1 pp-number, before any macro expansion happens.
+func (e *Expander) resolveDefined(line []hsToken) ([]hsToken, error) {
+	var out []hsToken
+	for i := 0; i < len(line); i++ {
+		t := line[i]
+		if t.tok.Type != preprocess.Identifier || t.tok.Raw != "defined" {
+			out = append(out, t)
+			continue
+		}
+
+		i++
+		if i >= len(line) {
+			return nil, newError(t.tok.Pos, `operator "defined" requires an identifier`)
+		}
+		name := ""
+		if line[i].tok.Type == '(' {
+			i++
+			if i >= len(line) || line[i].tok.Type != preprocess.Identifier {
+				return nil, newError(t.tok.Pos, `operator "defined" requires an identifier`)
+			}
+			name = line[i].tok.Raw
+			i++
+			if i >= len(line) || line[i].tok.Type != ')' {
+				return nil, newError(t.tok.Pos, `missing ')' after "defined"`)
+			}
+		} else if line[i].tok.Type == preprocess.Identifier {
+			name = line[i].tok.Raw
+		} else {
+			return nil, newError(t.tok.Pos, `operator "defined" requires an identifier`)
+		}
+
+		v := "0"
+		if e.macros.Defined(name) || isPredefinedName(name) {
+			v = "1"
+		}
+		out = append(out, hsToken{tok: &preprocess.Token{Type: preprocess.PPNumber, Val: v, Raw: v, Pos: t.tok.Pos}})
+	}
+	return out, nil
+}
+
+// divByZeroError marks an error as coming from dividing or taking the
+// remainder by zero, so that && and || can swallow it when the offending
+// side was never supposed to be evaluated.
+type divByZeroError struct{ pos lex.Pos }
+
+func (e *divByZeroError) Error() string { return "division by zero in #if expression" }
+
+func b2i(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// exprParser is a small recursive-descent parser/evaluator for the integer
+// constant expressions #if and #elif accept, following C11 6.6's grammar
+// restricted to the operators that can appear there.
+type exprParser struct {
+	toks []hsToken
+	pos  int
+	// skipEval is nonzero while parsing an operand of && or || that the
+	// left operand has already decided the result without.
+	skipEval int
+}
+
+func (p *exprParser) peekType() (preprocess.TokenType, bool) {
+	if p.pos >= len(p.toks) {
+		return 0, false
+	}
+	return p.toks[p.pos].tok.Type, true
+}
+
+func (p *exprParser) at(types ...preprocess.TokenType) bool {
+	ty, ok := p.peekType()
+	if !ok {
+		return false
+	}
+	for _, t := range types {
+		if ty == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) parseExpr() (int64, error) {
+	return p.parseTernary()
+}
+
+func (p *exprParser) parseTernary() (int64, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil {
+		return 0, err
+	}
+	if !p.at('?') {
+		return cond, nil
+	}
+	p.pos++
+	then, err := p.parseExpr()
+	if err != nil {
+		return 0, err
+	}
+	if !p.at(':') {
+		return 0, p.errHere("expected ':' in '?:' expression")
+	}
+	p.pos++
+	els, err := p.parseTernary()
+	if err != nil {
+		return 0, err
+	}
+	if cond != 0 {
+		return then, nil
+	}
+	return els, nil
+}
+
+// precedence, from loosest to tightest binding, matching C's operator
+// precedence for the subset #if expressions use. The tokenizer this
+// package sits on top of does not yet produce combined '<=' or '>='
+// tokens (only '<' and '>'), so those two are all parseBinary handles at
+// the relational level.
+var precedence = [][]preprocess.TokenType{
+	{preprocess.OrOr},
+	{preprocess.AndAnd},
+	{'|'},
+	{'^'},
+	{'&'},
+	{preprocess.Eq, preprocess.Ne},
+	{'<', '>'},
+	{preprocess.Shl, preprocess.Shr},
+	{'+', '-'},
+	{'*', '/', '%'},
+}
+
+func (p *exprParser) parseBinary(level int) (int64, error) {
+	if level >= len(precedence) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return 0, err
+	}
+	for p.at(precedence[level]...) {
+		opTok := p.toks[p.pos]
+		op := opTok.tok.Type
+		p.pos++
+
+		if op == preprocess.OrOr || op == preprocess.AndAnd {
+			isAnd := op == preprocess.AndAnd
+			shortCircuit := (isAnd && left == 0) || (!isAnd && left != 0)
+			if shortCircuit {
+				p.skipEval++
+			}
+			right, err := p.parseBinary(level + 1)
+			if shortCircuit {
+				p.skipEval--
+			}
+			if err != nil {
+				return 0, err
+			}
+			if isAnd {
+				left = b2i(left != 0 && right != 0)
+			} else {
+				left = b2i(left != 0 || right != 0)
+			}
+			continue
+		}
+
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return 0, err
+		}
+		left, err = applyBinary(op, left, right, opTok.tok.Pos)
+		if err != nil {
+			var dz *divByZeroError
+			if p.skipEval == 0 || !errors.As(err, &dz) {
+				return 0, err
+			}
+			// The value is discarded anyway; keep parsing the operand.
+			left = 0
+		}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (int64, error) {
+	if p.at('!', '-', '+', '~') {
+		op := p.toks[p.pos].tok.Type
+		p.pos++
+		v, err := p.parseUnary()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '!':
+			return b2i(v == 0), nil
+		case '-':
+			return -v, nil
+		case '+':
+			return v, nil
+		case '~':
+			return ^v, nil
+		}
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (int64, error) {
+	if p.pos >= len(p.toks) {
+		return 0, newError(lex.Pos{}, "unexpected end of #if expression")
+	}
+	t := p.toks[p.pos]
+	switch t.tok.Type {
+	case '(':
+		p.pos++
+		v, err := p.parseExpr()
+		if err != nil {
+			return 0, err
+		}
+		if !p.at(')') {
+			return 0, p.errHere("expected ')'")
+		}
+		p.pos++
+		return v, nil
+	case preprocess.PPNumber:
+		p.pos++
+		return parseIntLiteral(t.tok.Val, t.tok.Pos)
+	case preprocess.CharacterConstant:
+		p.pos++
+		if len(t.tok.Val) == 0 {
+			return 0, nil
+		}
+		return int64(t.tok.Val[0]), nil
+	}
+	return 0, p.errHere("expected an integer constant expression")
+}
+
+func (p *exprParser) errHere(msg string) error {
+	if p.pos < len(p.toks) {
+		return newError(p.toks[p.pos].tok.Pos, "%s", msg)
+	}
+	return newError(lex.Pos{}, "%s", msg)
+}
+
+func applyBinary(op preprocess.TokenType, l, r int64, pos lex.Pos) (int64, error) {
+	switch op {
+	case '|':
+		return l | r, nil
+	case '^':
+		return l ^ r, nil
+	case '&':
+		return l & r, nil
+	case '<':
+		return b2i(l < r), nil
+	case '>':
+		return b2i(l > r), nil
+	case preprocess.Eq:
+		return b2i(l == r), nil
+	case preprocess.Ne:
+		return b2i(l != r), nil
+	case preprocess.Shl:
+		return l << uint(r), nil
+	case preprocess.Shr:
+		return l >> uint(r), nil
+	case '+':
+		return l + r, nil
+	case '-':
+		return l - r, nil
+	case '*':
+		return l * r, nil
+	case '/':
+		if r == 0 {
+			return 0, &divByZeroError{pos: pos}
+		}
+		return l / r, nil
+	case '%':
+		if r == 0 {
+			return 0, &divByZeroError{pos: pos}
+		}
+		return l % r, nil
+	}
+	return 0, newError(pos, "unsupported operator in #if expression")
+}
+
+// parseIntLiteral parses a pp-number as a C integer constant, ignoring any
+// u/U/l/L suffix; goc's preprocessor treats every #if value as intmax_t.
+func parseIntLiteral(s string, pos lex.Pos) (int64, error) {
+	s = strings.TrimRight(s, "uUlL")
+	v, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		return 0, newError(pos, "invalid integer constant %q in #if expression", s)
+	}
+	return v, nil
+}
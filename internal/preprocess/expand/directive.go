@@ -0,0 +1,347 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expand
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hajimehoshi/goc/internal/lex"
+	"github.com/hajimehoshi/goc/internal/preprocess"
+)
+
+var conditionalDirectives = map[string]bool{
+	"if": true, "ifdef": true, "ifndef": true,
+	"elif": true, "else": true, "endif": true,
+}
+
+// directive is called with the '#' of a preprocessing directive as the
+// next front token and atLineStart true. It consumes the whole line.
+func (e *Expander) directive() error {
+	hash, _ := e.popFront()
+
+	t, err := e.peekFront(1)
+	if err != nil {
+		return err
+	}
+	if t.tok.Type == '\n' || t.tok.Type == preprocess.EOF {
+		// A null directive: "#" alone on a line is legal and does nothing.
+		if t.tok.Type == '\n' {
+			e.popFront()
+		}
+		e.atLineStart = true
+		return nil
+	}
+
+	if t.tok.Type != preprocess.Identifier {
+		e.readDirectiveLine()
+		return newError(hash.tok.Pos, "invalid preprocessing directive")
+	}
+	name, _ := e.popFront()
+
+	if e.skipping() && !conditionalDirectives[name.tok.Raw] {
+		e.readDirectiveLine()
+		return nil
+	}
+
+	switch name.tok.Raw {
+	case "define":
+		return e.doDefine(hash.tok.Pos)
+	case "undef":
+		return e.doUndef(hash.tok.Pos)
+	case "if":
+		return e.doIf(hash.tok.Pos)
+	case "ifdef":
+		return e.doIfdef(hash.tok.Pos, true)
+	case "ifndef":
+		return e.doIfdef(hash.tok.Pos, false)
+	case "elif":
+		return e.doElif(hash.tok.Pos)
+	case "else":
+		return e.doElse(hash.tok.Pos)
+	case "endif":
+		return e.doEndif(hash.tok.Pos)
+	case "include":
+		return e.doInclude(hash.tok.Pos)
+	case "line":
+		return e.doLine(hash.tok.Pos)
+	case "error":
+		return e.doError(hash.tok.Pos)
+	case "pragma":
+		return e.doPragma(hash.tok.Pos)
+	default:
+		e.readDirectiveLine()
+		return newError(hash.tok.Pos, "unknown preprocessing directive #%s", name.tok.Raw)
+	}
+}
+
+// readDirectiveLine consumes and returns the rest of the current line
+// (excluding the terminating '\n', which is consumed but not returned),
+// and marks the following token as the start of a new line.
+func (e *Expander) readDirectiveLine() []hsToken {
+	var toks []hsToken
+	for {
+		t, err := e.popFront()
+		if err != nil || t.tok.Type == '\n' {
+			break
+		}
+		toks = append(toks, t)
+	}
+	e.atLineStart = true
+	return toks
+}
+
+func (e *Expander) doDefine(pos lex.Pos) error {
+	nameTok, err := e.popFront()
+	if err != nil || nameTok.tok.Type != preprocess.Identifier {
+		e.readDirectiveLine()
+		return newError(pos, "macro name must be an identifier")
+	}
+
+	m := &Macro{Name: nameTok.tok.Raw, Pos: pos}
+
+	if next, err := e.peekFront(1); err == nil && next.tok.Type == '(' && next.tok.Adjacent {
+		e.popFront()
+		params, variadic, perr := e.parseParamList()
+		if perr != nil {
+			e.readDirectiveLine()
+			return perr
+		}
+		m.FuncLike = true
+		m.Params = params
+		m.Variadic = variadic
+	}
+
+	body := e.readDirectiveLine()
+	m.Body = make([]*preprocess.Token, len(body))
+	for i, t := range body {
+		m.Body[i] = t.tok
+	}
+	e.macros.Define(m)
+	return nil
+}
+
+func (e *Expander) parseParamList() ([]string, bool, error) {
+	var params []string
+	variadic := false
+	for {
+		t, err := e.popFront()
+		if err != nil {
+			return nil, false, newError(lex.Pos{}, "unterminated macro parameter list")
+		}
+		switch t.tok.Type {
+		case ')':
+			return params, variadic, nil
+		case ',':
+		case preprocess.DotDotDot:
+			variadic = true
+		case preprocess.Identifier:
+			params = append(params, t.tok.Raw)
+		default:
+			return nil, false, newError(t.tok.Pos, "unexpected token in macro parameter list")
+		}
+	}
+}
+
+func (e *Expander) doUndef(pos lex.Pos) error {
+	nameTok, err := e.popFront()
+	e.readDirectiveLine()
+	if err != nil || nameTok.tok.Type != preprocess.Identifier {
+		return newError(pos, "macro name must be an identifier")
+	}
+	e.macros.Undef(nameTok.tok.Raw)
+	return nil
+}
+
+func (e *Expander) doIf(pos lex.Pos) error {
+	line := e.readDirectiveLine()
+	if e.skipping() {
+		e.condStack = append(e.condStack, condFrame{taken: true, active: false, parentActive: false, pos: pos})
+		return nil
+	}
+	val, err := e.evalConstExpr(line, pos)
+	if err != nil {
+		return err
+	}
+	e.condStack = append(e.condStack, condFrame{taken: val != 0, active: val != 0, parentActive: true, pos: pos})
+	return nil
+}
+
+func (e *Expander) doIfdef(pos lex.Pos, wantDefined bool) error {
+	nameTok, _ := e.popFront()
+	e.readDirectiveLine()
+	if e.skipping() {
+		e.condStack = append(e.condStack, condFrame{taken: true, active: false, parentActive: false, pos: pos})
+		return nil
+	}
+	defined := e.macros.Defined(nameTok.tok.Raw) || isPredefinedName(nameTok.tok.Raw)
+	val := defined == wantDefined
+	e.condStack = append(e.condStack, condFrame{taken: val, active: val, parentActive: true, pos: pos})
+	return nil
+}
+
+func (e *Expander) doElif(pos lex.Pos) error {
+	line := e.readDirectiveLine()
+	if len(e.condStack) == 0 {
+		return newError(pos, "#elif without #if")
+	}
+	f := &e.condStack[len(e.condStack)-1]
+	if !f.parentActive {
+		return nil
+	}
+	if f.taken {
+		f.active = false
+		return nil
+	}
+	val, err := e.evalConstExpr(line, pos)
+	if err != nil {
+		return err
+	}
+	f.active = val != 0
+	if f.active {
+		f.taken = true
+	}
+	return nil
+}
+
+func (e *Expander) doElse(pos lex.Pos) error {
+	e.readDirectiveLine()
+	if len(e.condStack) == 0 {
+		return newError(pos, "#else without #if")
+	}
+	f := &e.condStack[len(e.condStack)-1]
+	if !f.parentActive {
+		return nil
+	}
+	f.active = !f.taken
+	f.taken = true
+	return nil
+}
+
+func (e *Expander) doEndif(pos lex.Pos) error {
+	e.readDirectiveLine()
+	if len(e.condStack) == 0 {
+		return newError(pos, "#endif without #if")
+	}
+	e.condStack = e.condStack[:len(e.condStack)-1]
+	return nil
+}
+
+func (e *Expander) doInclude(pos lex.Pos) error {
+	line := e.readDirectiveLine()
+	if len(line) == 0 {
+		return newError(pos, `#include expects "FILENAME" or <FILENAME>`)
+	}
+
+	var name string
+	var system bool
+	if line[0].tok.Type == preprocess.HeaderName {
+		name = line[0].tok.Val
+		system = strings.HasPrefix(line[0].tok.Raw, "<")
+	} else {
+		expanded, err := e.expandArg(line)
+		if err != nil {
+			return err
+		}
+		n, sys, err := headerNameFromTokens(expanded)
+		if err != nil {
+			return newError(pos, "#include %v", err)
+		}
+		name, system = n, sys
+	}
+
+	if e.resolver == nil {
+		return newError(pos, "#include %s: no include resolver configured", name)
+	}
+	src, filename, err := e.resolver.ResolveInclude(name, system, e.sources[len(e.sources)-1].filename)
+	if err != nil {
+		return newError(pos, "#include %s: %v", name, err)
+	}
+	e.sources = append(e.sources, includeFrame{r: preprocess.TokenizeSource(src), filename: filename})
+	e.atLineStart = true
+	return nil
+}
+
+// headerNameFromTokens reconstructs the header name a computed #include
+// (one whose operand is a macro rather than a literal header-name) names,
+// per C11 6.10.2p4: after macro expansion, the resulting tokens must match
+// one of the two header-name forms, either directly (a lone HeaderName or
+// string-literal token, e.g. from a macro defined as #define HDR "a.h") or
+// by spelling, once reassembled, a '<' h-char-sequence '>' (e.g. #define
+// HDR <a.h>, which the tokenizer has no reason to read as a header-name
+// while it is only a macro body).
+func headerNameFromTokens(toks []hsToken) (name string, system bool, err error) {
+	if len(toks) == 0 {
+		return "", false, fmt.Errorf(`expects "FILENAME" or <FILENAME>`)
+	}
+	if len(toks) == 1 {
+		switch toks[0].tok.Type {
+		case preprocess.HeaderName:
+			return toks[0].tok.Val, strings.HasPrefix(toks[0].tok.Raw, "<"), nil
+		case preprocess.StringLiteral:
+			return toks[0].tok.Val, false, nil
+		}
+	}
+	if toks[0].tok.Type == '<' && toks[len(toks)-1].tok.Type == '>' {
+		var sb strings.Builder
+		for _, t := range toks[1 : len(toks)-1] {
+			sb.WriteString(spellingOf(t.tok))
+		}
+		return sb.String(), true, nil
+	}
+	return "", false, fmt.Errorf("does not name a header after macro expansion")
+}
+
+func (e *Expander) doLine(pos lex.Pos) error {
+	line := e.readDirectiveLine()
+	expanded, err := e.expandArg(line)
+	if err != nil {
+		return err
+	}
+	if len(expanded) == 0 || expanded[0].tok.Type != preprocess.PPNumber {
+		return newError(pos, "#line requires a digit sequence")
+	}
+	n, err := strconv.Atoi(expanded[0].tok.Val)
+	if err != nil {
+		return newError(pos, "#line: invalid line number: %v", err)
+	}
+	cur := &e.sources[len(e.sources)-1]
+	// The #line directive itself is on pos.Line; it renumbers the line
+	// after it to n.
+	cur.lineBase = n - (pos.Line + 1)
+	if len(expanded) > 1 && expanded[1].tok.Type == preprocess.StringLiteral {
+		cur.filename = expanded[1].tok.Val
+	}
+	return nil
+}
+
+func (e *Expander) doError(pos lex.Pos) error {
+	line := e.readDirectiveLine()
+	var sb strings.Builder
+	for i, t := range line {
+		if i > 0 && !t.tok.Adjacent {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(spellingOf(t.tok))
+	}
+	return newError(pos, "#error %s", sb.String())
+}
+
+// doPragma consumes and ignores #pragma; goc has no pragmas of its own yet.
+func (e *Expander) doPragma(pos lex.Pos) error {
+	e.readDirectiveLine()
+	return nil
+}
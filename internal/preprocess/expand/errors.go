@@ -0,0 +1,36 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expand
+
+import (
+	"fmt"
+
+	"github.com/hajimehoshi/goc/internal/lex"
+)
+
+// Error is a macro-expansion or directive-processing error, annotated with
+// the source position it was detected at.
+type Error struct {
+	Pos lex.Pos
+	Msg string
+}
+
+func newError(pos lex.Pos, format string, args ...interface{}) *Error {
+	return &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: expand: %s", e.Pos, e.Msg)
+}
@@ -0,0 +1,241 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package expand turns a stream of raw pp-tokens into a stream of fully
+// expanded pp-tokens, per ISO C11 6.10: it executes #define, #undef,
+// #if/#ifdef/#ifndef/#elif/#else/#endif, #include, #line, #error and
+// #pragma, and performs macro replacement (including # stringification and
+// ## token-pasting) on everything else.
+package expand
+
+import (
+	"github.com/hajimehoshi/goc/internal/lex"
+	"github.com/hajimehoshi/goc/internal/preprocess"
+)
+
+// hideSet is the set of macro names a token must not be re-expanded with,
+// per Dave Prosser's algorithm for avoiding infinite macro recursion: when
+// macro M is expanded, M is added to the hide set of every token the
+// expansion produces, and an identifier whose hide set already contains its
+// own name is never expanded again.
+type hideSet map[string]bool
+
+func (h hideSet) has(name string) bool {
+	return h[name]
+}
+
+func (h hideSet) union(o hideSet) hideSet {
+	if len(h) == 0 {
+		return o
+	}
+	if len(o) == 0 {
+		return h
+	}
+	n := make(hideSet, len(h)+len(o))
+	for k := range h {
+		n[k] = true
+	}
+	for k := range o {
+		n[k] = true
+	}
+	return n
+}
+
+func (h hideSet) add(name string) hideSet {
+	n := make(hideSet, len(h)+1)
+	for k := range h {
+		n[k] = true
+	}
+	n[name] = true
+	return n
+}
+
+// hsToken pairs a pp-token with the hide set it currently carries. Hide
+// sets are only meaningful during expansion, so they live here rather than
+// on preprocess.Token itself.
+type hsToken struct {
+	tok *preprocess.Token
+	hs  hideSet
+}
+
+// Expander implements preprocess.PPTokenReader on top of a PPTokenReader of
+// raw pp-tokens, expanding macros and executing preprocessing directives as
+// it goes.
+type Expander struct {
+	macros   *MacroTable
+	resolver IncludeResolver
+	opts     options
+
+	sources []includeFrame // include stack; sources[len-1] is the active one
+
+	// front holds lookahead tokens that have not yet been committed to the
+	// output: tokens pushed back after a macro substitution (for
+	// rescanning, per C11 6.10.3.4) take priority over pulling a new raw
+	// token from the current source.
+	front []hsToken
+
+	out []*preprocess.Token
+
+	// atLineStart reports whether the next token, if any, would be the
+	// first token of a physical line (just after '\n', or the start of the
+	// translation unit).
+	atLineStart bool
+
+	condStack []condFrame
+}
+
+type includeFrame struct {
+	r        preprocess.PPTokenReader
+	filename string
+	// lineBase is added to a token's Pos.Line to get the line number
+	// __LINE__ reports, so that #line can renumber this source.
+	lineBase int
+}
+
+type condFrame struct {
+	// taken reports whether this #if/#elif/#else group has already had a
+	// true branch selected; once true, every later #elif/#else in the
+	// group is skipped regardless of its own condition.
+	taken bool
+	// active reports whether the *current* branch is the one being
+	// emitted.
+	active bool
+	// parentActive remembers whether the enclosing group was active, so a
+	// conditional nested inside a skipped group stays skipped no matter
+	// what its own condition evaluates to.
+	parentActive bool
+	pos          lex.Pos
+}
+
+// New wraps r, returning a PPTokenReader of fully expanded tokens. filename
+// is what __FILE__ expands to for tokens read directly from r (i.e. not from
+// a file pulled in via #include), and the fromFile passed to the
+// IncludeResolver for an #include in r. Diagnostics take their positions
+// from the tokens themselves.
+func New(filename string, r preprocess.PPTokenReader, opts ...Option) *Expander {
+	e := &Expander{
+		macros:      NewMacroTable(),
+		atLineStart: true,
+	}
+	for _, o := range opts {
+		o(&e.opts)
+	}
+	e.resolver = e.opts.resolver
+	definePredefined(e.macros, e.opts)
+	e.sources = []includeFrame{{r: r, filename: filename}}
+	return e
+}
+
+// Option configures an Expander.
+type Option func(*options)
+
+type options struct {
+	resolver IncludeResolver
+	date     string
+	time     string
+}
+
+// WithIncludeResolver sets the resolver used to satisfy #include
+// directives. Without one, any #include is an error.
+func WithIncludeResolver(r IncludeResolver) Option {
+	return func(o *options) { o.resolver = r }
+}
+
+// WithDateTime overrides the values __DATE__ and __TIME__ expand to, which
+// are otherwise left empty. goc never calls time.Now itself, so a driver
+// that wants conventional values must supply them explicitly.
+func WithDateTime(date, time string) Option {
+	return func(o *options) { o.date = date; o.time = time }
+}
+
+// NextPPToken returns the next fully expanded pp-token.
+func (e *Expander) NextPPToken() (*preprocess.Token, error) {
+	for len(e.out) == 0 {
+		if err := e.step(); err != nil {
+			return nil, err
+		}
+	}
+	tok := e.out[0]
+	e.out = e.out[1:]
+	return tok, nil
+}
+
+// skipping reports whether the current position is inside a false #if,
+// #elif or #else branch and so should not produce output or act on
+// non-conditional directives.
+func (e *Expander) skipping() bool {
+	if len(e.condStack) == 0 {
+		return false
+	}
+	f := e.condStack[len(e.condStack)-1]
+	return !f.active || !f.parentActive
+}
+
+// step advances the expander: it consumes one directive line (producing no
+// output), discards one line of a false conditional branch, or expands (and
+// possibly rescans) the next token, appending any newly-finished tokens to
+// e.out.
+func (e *Expander) step() error {
+	t, err := e.peekFront(1)
+	if err != nil {
+		return err
+	}
+
+	if t.tok.Type == preprocess.EOF {
+		// peekFront only ever hands back an EOF token once the outermost
+		// source is exhausted; an #include's own EOF is absorbed there.
+		if len(e.condStack) > 0 {
+			f := e.condStack[len(e.condStack)-1]
+			return newError(f.pos, "unterminated #if")
+		}
+		e.popFront()
+		e.out = append(e.out, t.tok)
+		return nil
+	}
+
+	if e.atLineStart && t.tok.Type == '#' {
+		return e.directive()
+	}
+
+	if e.skipping() {
+		e.skipLine()
+		return nil
+	}
+
+	if t.tok.Type == '\n' {
+		e.popFront()
+		e.atLineStart = true
+		e.out = append(e.out, t.tok)
+		return nil
+	}
+
+	e.atLineStart = false
+	return e.expandStep()
+}
+
+// skipLine discards tokens up to and including the next '\n', without
+// expanding them; it is used to drop the contents of a false #if/#elif/
+// #else branch. Nested directives are not interpreted here: directive is
+// only ever called at atLineStart, and skipping only drops non-directive
+// lines, so the directive dispatcher is what actually tracks the nesting of
+// conditionals inside a skipped group.
+func (e *Expander) skipLine() {
+	for {
+		t, err := e.popFront()
+		if err != nil || t.tok.Type == '\n' {
+			e.atLineStart = true
+			return
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expand
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hajimehoshi/goc/internal/lex"
+	"github.com/hajimehoshi/goc/internal/preprocess"
+)
+
+// expandAll runs src through New and returns the Raw spelling of every
+// token it produces, with '\n' dropped so tests can focus on content.
+func expandAll(t *testing.T, src string, opts ...Option) ([]string, error) {
+	t.Helper()
+	e := New("t.c", preprocess.Tokenize("t.c", strings.NewReader(src)), opts...)
+	var got []string
+	for {
+		tk, err := e.NextPPToken()
+		if err != nil {
+			return got, err
+		}
+		if tk.Type == preprocess.EOF {
+			return got, nil
+		}
+		if tk.Type == '\n' {
+			continue
+		}
+		got = append(got, tk.Raw)
+	}
+}
+
+func expandJoined(t *testing.T, src string, opts ...Option) string {
+	t.Helper()
+	toks, err := expandAll(t, src, opts...)
+	if err != nil {
+		t.Fatalf("expandAll(%q): %v", src, err)
+	}
+	return strings.Join(toks, " ")
+}
+
+func TestObjectLikeMacro(t *testing.T) {
+	got := expandJoined(t, "#define FOO 1 + 2\nFOO\n")
+	if want := "1 + 2"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFunctionLikeMacro(t *testing.T) {
+	got := expandJoined(t, "#define ADD(a, b) (a) + (b)\nADD(1, 2)\n")
+	if want := "( 1 ) + ( 2 )"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFunctionLikeMacroZeroArgCall(t *testing.T) {
+	got := expandJoined(t, "#define FOO() 42\nFOO()\n")
+	if want := "42"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStringize(t *testing.T) {
+	got := expandJoined(t, "#define STR(x) #x\nSTR(hello world)\n")
+	if want := `"hello world"`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTokenPaste(t *testing.T) {
+	got := expandJoined(t, "#define CAT(a, b) a ## b\nCAT(foo, bar)\n")
+	if want := "foobar"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestObjectLikeRecursionGuard(t *testing.T) {
+	// C11 6.10.3.4p2: a macro name found during its own expansion is left
+	// unexpanded, rather than recursing forever.
+	got := expandJoined(t, "#define A A\nA\n")
+	if want := "A"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFunctionLikeRecursionGuard(t *testing.T) {
+	got := expandJoined(t, "#define F(x) F(x) + 1\nF(1)\n")
+	if want := "F ( 1 ) + 1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestConditionalNesting(t *testing.T) {
+	src := `#define X 1
+#if X
+#ifdef Y
+nope
+#else
+yep
+#endif
+#endif
+`
+	got := expandJoined(t, src)
+	if want := "yep"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestConditionalSkipsUndefinedBranch(t *testing.T) {
+	src := `#if 0
+#error should not be reached
+nope
+#endif
+ok
+`
+	got := expandJoined(t, src)
+	if want := "ok"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFunctionLikeMacroWrongArgCount(t *testing.T) {
+	for _, src := range []string{
+		"#define ADD(a, b) a + b\nADD(1)\n",
+		"#define ADD(a, b) a + b\nADD(1, 2, 3)\n",
+	} {
+		if _, err := expandAll(t, src); err == nil {
+			t.Errorf("expandAll(%q): got no error, want an argument-count error", src)
+		}
+	}
+}
+
+// stubResolver is a minimal IncludeResolver that serves one in-memory file,
+// for exercising #include without touching a real filesystem.
+type stubResolver struct {
+	name string
+	body string
+}
+
+func (r stubResolver) ResolveInclude(name string, system bool, fromFile string) (lex.Source, string, error) {
+	if name != r.name {
+		return nil, "", fmt.Errorf("no such header %q", name)
+	}
+	return preprocess.NewFileSource(r.name, strings.NewReader(r.body)), r.name, nil
+}
+
+func TestComputedInclude(t *testing.T) {
+	resolver := stubResolver{name: "a.h", body: "int included_value;\n"}
+	src := "#define HDR <a.h>\n#include HDR\n"
+	got := expandJoined(t, src, WithIncludeResolver(resolver))
+	if want := "int included_value ;"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestIncludeResumesAfterIncludedFile(t *testing.T) {
+	// A #include's EOF must only end the included file, not the whole
+	// translation unit: tokens after the #include line still need to come
+	// out.
+	resolver := stubResolver{name: "a.h", body: "int included_value;\n"}
+	src := "#include \"a.h\"\nafter_include\n"
+	got := expandJoined(t, src, WithIncludeResolver(resolver))
+	if want := "int included_value ; after_include"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestIfWithMacroCallWrongArgCount(t *testing.T) {
+	// expandArg, used directly by #if (not the rescanning stream #define
+	// bodies go through), must still diagnose a definite argument-count
+	// mismatch rather than reporting it as some other, misleading error.
+	src := "#define ADD(a, b) a + b\n#if ADD(1)\nyes\n#endif\n"
+	if _, err := expandAll(t, src); err == nil {
+		t.Errorf("expandAll(%q): got no error, want an argument-count error", src)
+	}
+}
+
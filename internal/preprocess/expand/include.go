@@ -0,0 +1,34 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expand
+
+import "github.com/hajimehoshi/goc/internal/lex"
+
+// IncludeResolver locates the source for a #include directive. name is the
+// header name with its delimiters stripped (e.g. "stdio.h" for both
+// <stdio.h> and "stdio.h"); system reports which delimiter was used.
+// fromFile is the file the #include appeared in, for resolving relative
+// paths.
+//
+// The returned Source is pushed on the expander's include stack and
+// consumed exactly like any other source, so #include, #define and macro
+// expansion all work across the boundary. It must have had the same
+// translation phase 1/2 treatment (line splicing, mandatory trailing
+// newline) as the main file, or the included file won't parse the same way
+// it would if its contents had been pasted in directly; build it with
+// preprocess.NewFileSource rather than lex.NewSource directly.
+type IncludeResolver interface {
+	ResolveInclude(name string, system bool, fromFile string) (src lex.Source, filename string, err error)
+}
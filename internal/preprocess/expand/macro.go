@@ -0,0 +1,471 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expand
+
+import (
+	"strings"
+
+	"github.com/hajimehoshi/goc/internal/lex"
+	"github.com/hajimehoshi/goc/internal/preprocess"
+)
+
+// Macro is a #defined object-like or function-like macro.
+type Macro struct {
+	Name     string
+	FuncLike bool
+	// Variadic reports whether the last parameter is "...", referred to in
+	// the replacement list as __VA_ARGS__.
+	Variadic bool
+	// Params holds the named parameters, in order; it never includes
+	// "...", which Variadic tracks separately.
+	Params []string
+	Body   []*preprocess.Token
+	Pos    lex.Pos
+}
+
+// paramIndex reports the index into an argument list that name refers to,
+// if any.
+func (m *Macro) paramIndex(name string) (int, bool) {
+	for i, p := range m.Params {
+		if p == name {
+			return i, true
+		}
+	}
+	if m.Variadic && name == "__VA_ARGS__" {
+		return len(m.Params), true
+	}
+	return 0, false
+}
+
+// MacroTable is the set of macros currently in scope.
+type MacroTable struct {
+	m map[string]*Macro
+}
+
+func NewMacroTable() *MacroTable {
+	return &MacroTable{m: map[string]*Macro{}}
+}
+
+func (t *MacroTable) Define(m *Macro) {
+	t.m[m.Name] = m
+}
+
+func (t *MacroTable) Undef(name string) {
+	delete(t.m, name)
+}
+
+func (t *MacroTable) Lookup(name string) (*Macro, bool) {
+	m, ok := t.m[name]
+	return m, ok
+}
+
+func (t *MacroTable) Defined(name string) bool {
+	_, ok := t.m[name]
+	return ok
+}
+
+// expandStep consumes exactly one token from the front of the queue. If it
+// is not an invocation of a currently-visible macro, it is moved straight
+// to the output; otherwise the macro is substituted and the result is
+// pushed back to the front of the queue for rescanning, per C11 6.10.3.4.
+func (e *Expander) expandStep() error {
+	t, err := e.popFront()
+	if err != nil {
+		return err
+	}
+
+	name := t.tok.Raw
+	if t.tok.Type != preprocess.Identifier || t.hs.has(name) {
+		e.out = append(e.out, t.tok)
+		return nil
+	}
+
+	if pd, ok := e.predefinedToken(name, t.tok.Pos); ok {
+		e.pushFront([]hsToken{{tok: pd, hs: t.hs.add(name)}})
+		return nil
+	}
+
+	m, ok := e.macros.Lookup(name)
+	if !ok {
+		e.out = append(e.out, t.tok)
+		return nil
+	}
+
+	if !m.FuncLike {
+		os, err := e.substitute(m, nil, t.hs.add(name))
+		if err != nil {
+			return err
+		}
+		e.pushFront(os)
+		return nil
+	}
+
+	idx, err := e.nextSignificantFrontIndex(0)
+	if err != nil || e.front[idx].tok.Type != '(' {
+		// Not followed by '(': this is an ordinary identifier, not a call.
+		e.out = append(e.out, t.tok)
+		return nil
+	}
+	for i := 0; i < idx; i++ {
+		e.popFront() // drop the newlines between the name and '('
+	}
+	e.popFront() // consume '('
+
+	args, rparenHS, err := e.collectArgs(m)
+	if err != nil {
+		return err
+	}
+	hs := t.hs.union(rparenHS).add(name)
+	os, err := e.substitute(m, args, hs)
+	if err != nil {
+		return err
+	}
+	e.pushFront(os)
+	return nil
+}
+
+// nextSignificantFrontIndex returns the index, counting from from, of the
+// next front token that is not a newline, pulling more input as needed.
+func (e *Expander) nextSignificantFrontIndex(from int) (int, error) {
+	i := from
+	for {
+		t, err := e.peekFront(i + 1)
+		if err != nil {
+			return 0, err
+		}
+		if t.tok.Type != '\n' {
+			return i, nil
+		}
+		i++
+	}
+}
+
+// collectArgs reads the actual arguments of a function-like macro call from
+// the front queue, assuming the opening '(' has already been consumed. It
+// returns the raw (unexpanded) tokens of each argument and the hide set of
+// the closing ')'.
+func (e *Expander) collectArgs(m *Macro) ([][]hsToken, hideSet, error) {
+	namedCount := len(m.Params)
+	var args [][]hsToken
+	var cur []hsToken
+	depth := 1
+	for {
+		t, err := e.popFront()
+		if err != nil {
+			return nil, nil, newError(m.Pos, "unterminated call to macro %q", m.Name)
+		}
+		switch t.tok.Type {
+		case '\n':
+			// Macro invocations may span multiple lines; the newlines
+			// themselves carry no meaning inside the argument list.
+		case '(':
+			depth++
+			cur = append(cur, t)
+		case ')':
+			depth--
+			if depth == 0 {
+				args = append(args, cur)
+				checked, err := checkArgCount(m, args)
+				if err != nil {
+					return nil, nil, err
+				}
+				return checked, t.hs, nil
+			}
+			cur = append(cur, t)
+		case ',':
+			if depth == 1 && (!m.Variadic || len(args) < namedCount) {
+				args = append(args, cur)
+				cur = nil
+			} else {
+				cur = append(cur, t)
+			}
+		default:
+			cur = append(cur, t)
+		}
+	}
+}
+
+// argCountError marks an error checkArgCount produced: a call whose
+// arguments were fully collected (a matching ')' was found) but whose count
+// didn't match m's parameters. expandArg uses this to tell a definite
+// arg-count mismatch apart from a call that merely isn't closed yet, which
+// it treats very differently: the former is always a hard error, the
+// latter just means the identifier wasn't a macro invocation after all.
+type argCountError struct{ err *Error }
+
+func (e argCountError) Error() string { return e.err.Error() }
+
+// checkArgCount validates the number of arguments collected for a call to m
+// against C11 6.10.3p4, which requires the same number of arguments as
+// parameters (at least that many, for a variadic macro). It also normalizes
+// the one case the grammar leaves looking like a mismatch but every
+// compiler accepts: FOO() invoking a zero-parameter macro collects a single
+// empty argument, which is treated as no arguments at all.
+func checkArgCount(m *Macro, args [][]hsToken) ([][]hsToken, error) {
+	if len(m.Params) == 0 && !m.Variadic && len(args) == 1 && len(args[0]) == 0 {
+		return nil, nil
+	}
+	if m.Variadic {
+		if len(args) < len(m.Params) {
+			return nil, argCountError{err: newError(m.Pos, "macro %q requires at least %d arguments, but only %d given", m.Name, len(m.Params), len(args))}
+		}
+		return args, nil
+	}
+	if len(args) != len(m.Params) {
+		return nil, argCountError{err: newError(m.Pos, "macro %q requires %d arguments, but %d given", m.Name, len(m.Params), len(args))}
+	}
+	return args, nil
+}
+
+func argOrEmpty(args [][]hsToken, idx int) []hsToken {
+	if idx < 0 || idx >= len(args) {
+		return nil
+	}
+	return args[idx]
+}
+
+// substitute builds the replacement sequence for an invocation of m, with
+// args (nil for an object-like macro) already collected but not yet
+// macro-expanded, per C11 6.10.3.1-3. hs is unioned into every resulting
+// token's hide set.
+func (e *Expander) substitute(m *Macro, args [][]hsToken, hs hideSet) ([]hsToken, error) {
+	var os []hsToken
+	body := m.Body
+	for i := 0; i < len(body); i++ {
+		tok := body[i]
+
+		if m.FuncLike && tok.Type == '#' && i+1 < len(body) {
+			if idx, ok := m.paramIndex(body[i+1].Raw); ok {
+				str := stringize(argOrEmpty(args, idx))
+				os = append(os, hsToken{tok: &preprocess.Token{
+					Type: preprocess.StringLiteral,
+					Val:  str,
+					Raw:  `"` + str + `"`,
+					Pos:  tok.Pos,
+				}})
+				i++
+				continue
+			}
+		}
+
+		if tok.Type == preprocess.HashHash {
+			var rhs []hsToken
+			if i+1 < len(body) {
+				if idx, ok := m.paramIndex(body[i+1].Raw); ok {
+					rhs = argOrEmpty(args, idx)
+				} else {
+					rhs = []hsToken{{tok: body[i+1]}}
+				}
+				i++
+			}
+			switch {
+			case len(os) == 0:
+				os = append(os, rhs...)
+			case len(rhs) == 0:
+				// Pasting with an empty argument leaves the left operand
+				// unchanged.
+			default:
+				left := os[len(os)-1]
+				os = append(os[:len(os)-1], paste(left, rhs[0]))
+				os = append(os, rhs[1:]...)
+			}
+			continue
+		}
+
+		if idx, ok := m.paramIndex(tok.Raw); ok && tok.Type == preprocess.Identifier {
+			expanded, err := e.expandArg(argOrEmpty(args, idx))
+			if err != nil {
+				return nil, err
+			}
+			os = append(os, expanded...)
+			continue
+		}
+
+		os = append(os, hsToken{tok: tok})
+	}
+	for i := range os {
+		os[i].hs = os[i].hs.union(hs)
+	}
+	return os, nil
+}
+
+// expandArg fully macro-expands a self-contained token sequence, such as a
+// macro argument. Unlike the streaming path used for the top-level token
+// stream, it never reads beyond the tokens it was given. A nested call
+// whose arguments are definitely wrong in number (argCountError) is a hard
+// error; a nested call that simply never finds a matching ')' within arg is
+// not, since arg is all of the input expandArg is allowed to look at, and
+// is instead left as an ordinary, unexpanded identifier.
+func (e *Expander) expandArg(arg []hsToken) ([]hsToken, error) {
+	local := append([]hsToken{}, arg...)
+	var out []hsToken
+	for len(local) > 0 {
+		t := local[0]
+		name := t.tok.Raw
+
+		if t.tok.Type != preprocess.Identifier || t.hs.has(name) {
+			out = append(out, t)
+			local = local[1:]
+			continue
+		}
+
+		if pd, ok := e.predefinedToken(name, t.tok.Pos); ok {
+			local = append([]hsToken{{tok: pd, hs: t.hs.add(name)}}, local[1:]...)
+			continue
+		}
+
+		m, ok := e.macros.Lookup(name)
+		if !ok {
+			out = append(out, t)
+			local = local[1:]
+			continue
+		}
+
+		if !m.FuncLike {
+			os, err := e.substitute(m, nil, t.hs.add(name))
+			if err != nil {
+				return nil, err
+			}
+			local = append(append([]hsToken{}, os...), local[1:]...)
+			continue
+		}
+
+		if len(local) < 2 || local[1].tok.Type != '(' {
+			out = append(out, t)
+			local = local[1:]
+			continue
+		}
+		rest := local[2:]
+		args, rparenHS, n, err := collectArgsFromSlice(m, rest)
+		if err != nil {
+			if _, ok := err.(argCountError); ok {
+				return nil, err
+			}
+			out = append(out, t)
+			local = local[1:]
+			continue
+		}
+		hs := t.hs.union(rparenHS).add(name)
+		os, err := e.substitute(m, args, hs)
+		if err != nil {
+			return nil, err
+		}
+		local = append(append([]hsToken{}, os...), rest[n:]...)
+	}
+	return out, nil
+}
+
+// collectArgsFromSlice is collectArgs's counterpart for expandArg, which
+// operates on a fixed slice instead of the expander's streaming front
+// queue. It returns the arguments, the closing ')' hide set, and how many
+// elements of toks were consumed.
+func collectArgsFromSlice(m *Macro, toks []hsToken) ([][]hsToken, hideSet, int, error) {
+	namedCount := len(m.Params)
+	var args [][]hsToken
+	var cur []hsToken
+	depth := 1
+	for i, t := range toks {
+		switch t.tok.Type {
+		case '(':
+			depth++
+			cur = append(cur, t)
+		case ')':
+			depth--
+			if depth == 0 {
+				args = append(args, cur)
+				checked, err := checkArgCount(m, args)
+				if err != nil {
+					return nil, nil, 0, err
+				}
+				return checked, t.hs, i + 1, nil
+			}
+			cur = append(cur, t)
+		case ',':
+			if depth == 1 && (!m.Variadic || len(args) < namedCount) {
+				args = append(args, cur)
+				cur = nil
+			} else {
+				cur = append(cur, t)
+			}
+		default:
+			cur = append(cur, t)
+		}
+	}
+	return nil, nil, 0, newError(m.Pos, "unterminated call to macro %q", m.Name)
+}
+
+// stringize implements the # operator (C11 6.10.3.2): the spelling of each
+// token in toks, with a single space wherever the source had whitespace,
+// and with '"' and '\' escaped inside string and character literals.
+func stringize(toks []hsToken) string {
+	var sb strings.Builder
+	for i, t := range toks {
+		if i > 0 && !t.tok.Adjacent {
+			sb.WriteByte(' ')
+		}
+		spelling := spellingOf(t.tok)
+		if t.tok.Type == preprocess.StringLiteral || t.tok.Type == preprocess.CharacterConstant {
+			for _, r := range spelling {
+				if r == '"' || r == '\\' {
+					sb.WriteByte('\\')
+				}
+				sb.WriteRune(r)
+			}
+			continue
+		}
+		sb.WriteString(spelling)
+	}
+	return sb.String()
+}
+
+func spellingOf(tok *preprocess.Token) string {
+	if tok.Raw != "" {
+		return tok.Raw
+	}
+	return tok.Val
+}
+
+// paste implements the ## operator (C11 6.10.3.3) by concatenating the
+// spellings of a and b into a single new pp-token. The result's type is a
+// best-effort guess from its first character: a real compiler would have to
+// re-lex it and diagnose an invalid token, but goc's callers only ever feed
+// pasted identifiers and numbers back into the tokenizer indirectly, via
+// the parser.
+func paste(a, b hsToken) hsToken {
+	raw := spellingOf(a.tok) + spellingOf(b.tok)
+	return hsToken{
+		tok: &preprocess.Token{
+			Type: pastedType(raw),
+			Val:  raw,
+			Raw:  raw,
+			Pos:  a.tok.Pos,
+		},
+		hs: a.hs.union(b.hs),
+	}
+}
+
+func pastedType(raw string) preprocess.TokenType {
+	if raw == "" {
+		return preprocess.Other
+	}
+	switch b := raw[0]; {
+	case lex.IsNondigit(b):
+		return preprocess.Identifier
+	case lex.IsDigit(b):
+		return preprocess.PPNumber
+	default:
+		return preprocess.Other
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expand
+
+import (
+	"strconv"
+
+	"github.com/hajimehoshi/goc/internal/lex"
+	"github.com/hajimehoshi/goc/internal/preprocess"
+)
+
+// definePredefined installs the predefined macros whose value does not
+// depend on the position of the token that names them. __FILE__ and
+// __LINE__ do depend on position and are handled by predefinedToken
+// instead.
+func definePredefined(t *MacroTable, o options) {
+	t.Define(&Macro{
+		Name: "__STDC__",
+		Body: []*preprocess.Token{{Type: preprocess.PPNumber, Val: "1", Raw: "1"}},
+	})
+	t.Define(&Macro{
+		Name: "__DATE__",
+		Body: []*preprocess.Token{{Type: preprocess.StringLiteral, Val: o.date, Raw: strconv.Quote(o.date)}},
+	})
+	t.Define(&Macro{
+		Name: "__TIME__",
+		Body: []*preprocess.Token{{Type: preprocess.StringLiteral, Val: o.time, Raw: strconv.Quote(o.time)}},
+	})
+}
+
+// isPredefinedName reports whether name is a predefined macro not tracked
+// in the MacroTable, for the purposes of #ifdef and the defined operator.
+func isPredefinedName(name string) bool {
+	return name == "__FILE__" || name == "__LINE__"
+}
+
+// predefinedToken produces the expansion of __FILE__ or __LINE__ at pos, if
+// name is one of them.
+func (e *Expander) predefinedToken(name string, pos lex.Pos) (*preprocess.Token, bool) {
+	cur := &e.sources[len(e.sources)-1]
+	switch name {
+	case "__FILE__":
+		return &preprocess.Token{
+			Type: preprocess.StringLiteral,
+			Val:  cur.filename,
+			Raw:  strconv.Quote(cur.filename),
+			Pos:  pos,
+		}, true
+	case "__LINE__":
+		v := strconv.Itoa(pos.Line + cur.lineBase)
+		return &preprocess.Token{Type: preprocess.PPNumber, Val: v, Raw: v, Pos: pos}, true
+	}
+	return nil, false
+}
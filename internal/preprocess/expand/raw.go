@@ -0,0 +1,59 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package expand
+
+import "github.com/hajimehoshi/goc/internal/preprocess"
+
+// peekFront ensures e.front holds at least n tokens and returns the n-th
+// one (1-based), pulling fresh tokens from the active include-stack source
+// as needed. Per this codebase's PPTokenReader convention, end-of-input is
+// signaled by a Token{Type: EOF} with a nil error, never a real error; when
+// that EOF comes from anything but the outermost source, peekFront pops the
+// include stack and keeps pulling from what's underneath instead of handing
+// the EOF token to the caller, so #include doesn't end the translation unit
+// early. Only the outermost source's EOF ever reaches e.front.
+func (e *Expander) peekFront(n int) (hsToken, error) {
+	for len(e.front) < n {
+		tok, err := e.sources[len(e.sources)-1].r.NextPPToken()
+		if err != nil {
+			var zero hsToken
+			return zero, err
+		}
+		if tok.Type == preprocess.EOF && len(e.sources) > 1 {
+			e.sources = e.sources[:len(e.sources)-1]
+			e.atLineStart = true
+			continue
+		}
+		e.front = append(e.front, hsToken{tok: tok, hs: nil})
+	}
+	return e.front[n-1], nil
+}
+
+// popFront removes and returns the next token, pulling one if necessary.
+func (e *Expander) popFront() (hsToken, error) {
+	t, err := e.peekFront(1)
+	if err != nil {
+		return t, err
+	}
+	e.front = e.front[1:]
+	return t, nil
+}
+
+// pushFront prepends toks to the front of the queue, so they are the next
+// tokens considered; it is how a macro substitution's result is rescanned
+// for further macro calls together with whatever follows it in the source.
+func (e *Expander) pushFront(toks []hsToken) {
+	e.front = append(append([]hsToken{}, toks...), e.front...)
+}
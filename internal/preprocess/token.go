@@ -0,0 +1,71 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preprocess
+
+import (
+	"github.com/hajimehoshi/goc/internal/lex"
+)
+
+// TokenType represents the kind of a pp-token. Single-character tokens
+// (punctuators, '\n', ...) reuse their byte value; multi-character tokens
+// use the named constants below, which are negative so that they can never
+// collide with a byte value.
+type TokenType int
+
+const (
+	EOF TokenType = -(iota + 1)
+	Identifier
+	PPNumber
+	CharacterConstant
+	StringLiteral
+	HeaderName
+	Other
+	Inc
+	Dec
+	AddEq
+	SubEq
+	Arrow
+	MulEq
+	DivEq
+	ModEq
+	Eq
+	Ne
+	Shl
+	Shr
+	ShlEq
+	ShrEq
+	AndAnd
+	OrOr
+	AndEq
+	OrEq
+	XorEq
+	HashHash
+	DotDotDot
+)
+
+// Token is a single preprocessing token as defined by C11 6.4.
+type Token struct {
+	Type TokenType
+	Val  string
+	Raw  string
+
+	// Adjacent reports whether this token is not preceded by whitespace in
+	// the source text.
+	Adjacent bool
+
+	// Pos is the position of the first character of the token in the
+	// original source file, before any macro expansion.
+	Pos lex.Pos
+}
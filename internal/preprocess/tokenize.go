@@ -15,8 +15,6 @@
 package preprocess
 
 import (
-	"bufio"
-	"fmt"
 	"io"
 
 	"github.com/hajimehoshi/goc/internal/ioutil"
@@ -28,7 +26,8 @@ type PPTokenReader interface {
 }
 
 type tokenizer struct {
-	src lex.Source
+	src  lex.Source
+	opts tokenizeOptions
 
 	// ppstate represents the current context is in the preprocessor or not.
 	// -1 means header-name is no longer expected in the current line.
@@ -97,9 +96,15 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 		}
 		return &Token{
 			Type: EOF,
+			Pos:  src.Pos(),
 		}, nil
 	}
 
+	// pos is the position of the first character of the token about to be
+	// read. Peek does not move the source position, so it is safe to read
+	// it once up front.
+	pos := src.Pos()
+
 	t.wasSpace = t.isSpace
 	t.isSpace = lex.IsWhitespace(bs[0])
 
@@ -111,6 +116,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 			Type: TokenType(b),
 			Val:  string(bs[:1]),
 			Raw:  string(bs[:1]),
+			Pos:  pos,
 		}, nil
 	case ' ', '\t', '\v', '\f', '\r':
 		// Space
@@ -125,6 +131,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 					Type: Inc,
 					Val:  string(bs[:2]),
 					Raw:  string(bs[:2]),
+					Pos:  pos,
 				}, nil
 			case '=':
 				src.Discard(2)
@@ -132,6 +139,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 					Type: AddEq,
 					Val:  string(bs[:2]),
 					Raw:  string(bs[:2]),
+					Pos:  pos,
 				}, nil
 			}
 		}
@@ -144,6 +152,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 					Type: Dec,
 					Val:  string(bs[:2]),
 					Raw:  string(bs[:2]),
+					Pos:  pos,
 				}, nil
 			case '=':
 				src.Discard(2)
@@ -151,6 +160,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 					Type: SubEq,
 					Val:  string(bs[:2]),
 					Raw:  string(bs[:2]),
+					Pos:  pos,
 				}, nil
 			case '>':
 				src.Discard(2)
@@ -158,6 +168,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 					Type: Arrow,
 					Val:  string(bs[:2]),
 					Raw:  string(bs[:2]),
+					Pos:  pos,
 				}, nil
 			}
 		}
@@ -168,6 +179,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 				Type: MulEq,
 				Val:  string(bs[:2]),
 				Raw:  string(bs[:2]),
+				Pos:  pos,
 			}, nil
 		}
 	case '/':
@@ -199,7 +211,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 						return nil, err
 					}
 					if len(bs) <= 1 {
-						return nil, fmt.Errorf("preprocess: unclosed block comment")
+						return nil, newError(pos, "unclosed block comment")
 					}
 					if bs[0] == '*' && bs[1] == '/' {
 						src.Discard(2)
@@ -214,17 +226,41 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 					Type: DivEq,
 					Val:  string(bs[:2]),
 					Raw:  string(bs[:2]),
+					Pos:  pos,
 				}, nil
 			}
 		}
 	case '%':
-		if len(bs) >= 2 && bs[1] == '=' {
-			src.Discard(2)
-			return &Token{
-				Type: ModEq,
-				Val:  string(bs[:2]),
-				Raw:  string(bs[:2]),
-			}, nil
+		if len(bs) >= 2 {
+			switch bs[1] {
+			case '=':
+				src.Discard(2)
+				return &Token{
+					Type: ModEq,
+					Val:  string(bs[:2]),
+					Raw:  string(bs[:2]),
+					Pos:  pos,
+				}, nil
+			case '>':
+				// Digraph spelling of '}' (C11 6.4.6p3).
+				src.Discard(2)
+				return &Token{Type: '}', Val: "}", Raw: string(bs[:2]), Pos: pos}, nil
+			case ':':
+				// Digraph spelling of '#', or of '##' when doubled
+				// (C11 6.4.6p3).
+				if len(bs) >= 3 && bs[2] == '%' {
+					bs4, err := src.Peek(4)
+					if err != nil && err != io.EOF {
+						return nil, err
+					}
+					if len(bs4) >= 4 && bs4[3] == ':' {
+						src.Discard(4)
+						return &Token{Type: HashHash, Val: "##", Raw: string(bs4[:4]), Pos: pos}, nil
+					}
+				}
+				src.Discard(2)
+				return &Token{Type: '#', Val: "#", Raw: string(bs[:2]), Pos: pos}, nil
+			}
 		}
 	case '=':
 		if len(bs) >= 2 && bs[1] == '=' {
@@ -233,6 +269,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 				Type: Eq,
 				Val:  string(bs[:2]),
 				Raw:  string(bs[:2]),
+				Pos:  pos,
 			}, nil
 		}
 	case '<':
@@ -246,23 +283,37 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 				Type: HeaderName,
 				Val:  val,
 				Raw:  buf.Buf(),
+				Pos:  pos,
 			}, nil
 		}
-		if len(bs) >= 2 && bs[1] == '<' {
-			if len(bs) >= 3 && bs[2] == '=' {
-				src.Discard(3)
+		if len(bs) >= 2 {
+			switch bs[1] {
+			case ':':
+				// Digraph spelling of '[' (C11 6.4.6p3).
+				src.Discard(2)
+				return &Token{Type: '[', Val: "[", Raw: string(bs[:2]), Pos: pos}, nil
+			case '%':
+				// Digraph spelling of '{' (C11 6.4.6p3).
+				src.Discard(2)
+				return &Token{Type: '{', Val: "{", Raw: string(bs[:2]), Pos: pos}, nil
+			case '<':
+				if len(bs) >= 3 && bs[2] == '=' {
+					src.Discard(3)
+					return &Token{
+						Type: ShlEq,
+						Val:  string(bs[:3]),
+						Raw:  string(bs[:3]),
+						Pos:  pos,
+					}, nil
+				}
+				src.Discard(2)
 				return &Token{
-					Type: ShlEq,
-					Val:  string(bs[:3]),
-					Raw:  string(bs[:3]),
+					Type: Shl,
+					Val:  string(bs[:2]),
+					Raw:  string(bs[:2]),
+					Pos:  pos,
 				}, nil
 			}
-			src.Discard(2)
-			return &Token{
-				Type: Shl,
-				Val:  string(bs[:2]),
-				Raw:  string(bs[:2]),
-			}, nil
 		}
 	case '>':
 		if len(bs) >= 2 && bs[1] == '>' {
@@ -272,6 +323,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 					Type: ShrEq,
 					Val:  string(bs[:3]),
 					Raw:  string(bs[:3]),
+					Pos:  pos,
 				}, nil
 			}
 			src.Discard(2)
@@ -279,6 +331,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 				Type: Shr,
 				Val:  string(bs[:2]),
 				Raw:  string(bs[:2]),
+				Pos:  pos,
 			}, nil
 		}
 	case '&':
@@ -290,6 +343,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 					Type: AndAnd,
 					Val:  string(bs[:2]),
 					Raw:  string(bs[:2]),
+					Pos:  pos,
 				}, nil
 			case '=':
 				src.Discard(2)
@@ -297,6 +351,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 					Type: AndEq,
 					Val:  string(bs[:2]),
 					Raw:  string(bs[:2]),
+					Pos:  pos,
 				}, nil
 			}
 		}
@@ -309,6 +364,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 					Type: OrOr,
 					Val:  string(bs[:2]),
 					Raw:  string(bs[:2]),
+					Pos:  pos,
 				}, nil
 			case '=':
 				src.Discard(2)
@@ -316,6 +372,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 					Type: OrEq,
 					Val:  string(bs[:2]),
 					Raw:  string(bs[:2]),
+					Pos:  pos,
 				}, nil
 			}
 		}
@@ -326,6 +383,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 				Type: Ne,
 				Val:  string(bs[:2]),
 				Raw:  string(bs[:2]),
+				Pos:  pos,
 			}, nil
 		}
 	case '^':
@@ -335,6 +393,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 				Type: XorEq,
 				Val:  string(bs[:2]),
 				Raw:  string(bs[:2]),
+				Pos:  pos,
 			}, nil
 		}
 	case '\'':
@@ -348,6 +407,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 			Type: CharacterConstant,
 			Val:  string(val),
 			Raw:  buf.Buf(),
+			Pos:  pos,
 		}, nil
 	case '"':
 		if t.headerNameExpected() {
@@ -360,6 +420,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 				Type: HeaderName,
 				Val:  val,
 				Raw:  buf.Buf(),
+				Pos:  pos,
 			}, nil
 		}
 		// String literal
@@ -372,6 +433,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 			Type: StringLiteral,
 			Val:  val,
 			Raw:  buf.Buf(),
+			Pos:  pos,
 		}, nil
 	case '.':
 		if len(bs) >= 2 {
@@ -379,6 +441,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 				src.Discard(3)
 				return &Token{
 					Type: DotDotDot,
+					Pos:  pos,
 				}, nil
 			}
 			buf := lex.NewBufSource(src)
@@ -390,6 +453,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 				Type: PPNumber,
 				Val:  val,
 				Raw:  buf.Buf(),
+				Pos:  pos,
 			}, nil
 		}
 	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
@@ -402,6 +466,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 			Type: PPNumber,
 			Val:  val,
 			Raw:  buf.Buf(),
+			Pos:  pos,
 		}, nil
 	case '#':
 		if len(bs) >= 2 && bs[1] == '#' {
@@ -410,13 +475,21 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 				Type: HashHash,
 				Val:  string(bs[:2]),
 				Raw:  string(bs[:2]),
+				Pos:  pos,
 			}, nil
 		}
-	case ';', '(', ')', ',', '{', '}', '[', ']', '?', ':', '~':
+	case ':':
+		if len(bs) >= 2 && bs[1] == '>' {
+			// Digraph spelling of ']' (C11 6.4.6p3).
+			src.Discard(2)
+			return &Token{Type: ']', Val: "]", Raw: string(bs[:2]), Pos: pos}, nil
+		}
+		// Single character token
+	case ';', '(', ')', ',', '{', '}', '[', ']', '?', '~':
 		// Single character token
 	default:
-		if lex.IsNondigit(b) {
-			name, err := lex.ReadIdentifier(src)
+		if lex.IsNondigit(b) || lex.IsUCNStart(bs) || (t.opts.dollarSigns && b == '$') {
+			name, err := lex.ReadIdentifier(src, t.opts.dollarSigns)
 			if err != nil {
 				return nil, err
 			}
@@ -424,6 +497,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 				Type: Identifier,
 				Val:  "", // TODO: ?
 				Raw:  name,
+				Pos:  pos,
 			}, nil
 		}
 
@@ -448,6 +522,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 			Type: Other,
 			Val:  string(val),
 			Raw:  string(val),
+			Pos:  pos,
 		}, nil
 	}
 
@@ -457,6 +532,7 @@ func (t *tokenizer) nextImpl(src lex.Source) (*Token, error) {
 		Type: TokenType(bs[0]),
 		Val:  string(bs[:1]),
 		Raw:  string(bs[:1]),
+		Pos:  pos,
 	}, nil
 }
 
@@ -473,9 +549,71 @@ func (t *tokenizer) NextPPToken() (*Token, error) {
 	}
 }
 
-func Tokenize(src io.Reader) PPTokenReader {
+// Option configures Tokenize.
+//
+// Trigraphs, digraphs (C11 6.4.6p3) and universal-character-names are all
+// alternate spellings C11 allows for characters a source file's native
+// encoding might not have, but they differ in how much real-world C relies
+// on them, and Tokenize's defaults follow suit: digraphs and UCNs are
+// recognized unconditionally, matching every mainstream compiler, while
+// trigraphs (WithTrigraphs) and '$' in identifiers (WithDollarSignsInIdentifiers)
+// are both opt-in extensions to the base language.
+type Option func(*tokenizeOptions)
+
+type tokenizeOptions struct {
+	trigraphs   bool
+	dollarSigns bool
+}
+
+// WithTrigraphs enables trigraph replacement (C11 5.2.1.1) as translation
+// phase 1, before line splicing or tokenization sees the source at all.
+// Tokenize leaves trigraphs alone unless asked for them: they are all but
+// extinct in real-world C, and silently rewriting, say, "??!" to '|' inside
+// a string literal that never meant to contain a trigraph is more likely to
+// surprise a caller than help one.
+func WithTrigraphs() Option {
+	return func(o *tokenizeOptions) { o.trigraphs = true }
+}
+
+// WithDollarSignsInIdentifiers allows '$' in identifiers, a common extension
+// to C11 6.4.2.1 that GCC and Clang both enable by default. Tokenize does
+// not enable it unless asked, since it is not part of the standard grammar.
+func WithDollarSignsInIdentifiers() Option {
+	return func(o *tokenizeOptions) { o.dollarSigns = true }
+}
+
+func Tokenize(filename string, src io.Reader, opts ...Option) PPTokenReader {
+	return TokenizeSource(NewFileSource(filename, src, opts...), opts...)
+}
+
+// NewFileSource builds a lex.Source from a raw io.Reader, applying the same
+// translation phase 1/2 treatment Tokenize gives its own input: optional
+// trigraph replacement, then mandatory backslash-newline splicing and a
+// trailing newline if src doesn't already end with one. An
+// expand.IncludeResolver should use this (or replicate it) to build the
+// lex.Source it returns for a #include, so an included file gets the same
+// treatment as the file that included it.
+func NewFileSource(filename string, src io.Reader, opts ...Option) lex.Source {
+	var o tokenizeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.trigraphs {
+		src = ioutil.NewTrigraphReader(src)
+	}
 	src = ioutil.NewBackslashNewLineStripper(ioutil.NewLastNewLineAdder(src))
+	return lex.NewSource(filename, src)
+}
+
+// TokenizeSource is Tokenize for callers that already have a lex.Source,
+// such as an expand.IncludeResolver resolving a #include directive.
+func TokenizeSource(src lex.Source, opts ...Option) PPTokenReader {
+	var o tokenizeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
 	return &tokenizer{
-		src: bufio.NewReader(src),
+		src:  src,
+		opts: o,
 	}
 }
@@ -0,0 +1,76 @@
+// Copyright 2018 Hajime Hoshi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preprocess
+
+import (
+	"strings"
+	"testing"
+)
+
+func tokenizeAll(t *testing.T, src string) []*Token {
+	t.Helper()
+	r := Tokenize("test.c", strings.NewReader(src))
+	var toks []*Token
+	for {
+		tk, err := r.NextPPToken()
+		if err != nil {
+			t.Fatalf("NextPPToken: %v", err)
+		}
+		if tk.Type == EOF {
+			break
+		}
+		if tk.Type == '\n' {
+			continue
+		}
+		toks = append(toks, tk)
+	}
+	return toks
+}
+
+// TestDigraphsRoundTripToPunctuators checks that a translation unit written
+// with digraphs tokenizes to the same token types and values as the
+// equivalent punctuator spelling, while still remembering its own spelling
+// in Raw (C11 6.4.6p3: digraphs behave identically to the punctuators they
+// stand for, except when spelled out again by stringization).
+func TestDigraphsRoundTripToPunctuators(t *testing.T) {
+	const digraphSrc = `%:define X(a) <: a :>
+int a<:3:> = <%1,2,3%>;
+`
+	const punctSrc = `#define X(a) [ a ]
+int a[3] = {1,2,3};
+`
+	digraphToks := tokenizeAll(t, digraphSrc)
+	punctToks := tokenizeAll(t, punctSrc)
+
+	if len(digraphToks) != len(punctToks) {
+		t.Fatalf("got %d tokens from the digraph source, want %d (from the punctuator source)", len(digraphToks), len(punctToks))
+	}
+	for i, d := range digraphToks {
+		p := punctToks[i]
+		if d.Type != p.Type || d.Val != p.Val {
+			t.Errorf("token %d: got {Type: %v, Val: %q}, want {Type: %v, Val: %q}", i, d.Type, d.Val, p.Type, p.Val)
+		}
+	}
+
+	wantRaw := map[int]string{0: "%:", 6: "<:", 8: ":>", 11: "<:", 13: ":>", 15: "<%", 21: "%>"}
+	for i, raw := range wantRaw {
+		if i >= len(digraphToks) {
+			t.Fatalf("token %d out of range (only got %d tokens)", i, len(digraphToks))
+		}
+		if digraphToks[i].Raw != raw {
+			t.Errorf("token %d: got Raw %q, want %q", i, digraphToks[i].Raw, raw)
+		}
+	}
+}